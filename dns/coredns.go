@@ -5,25 +5,60 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+// defaultResolvers are the recursive nameservers queried by WaitForPropagation
+// when Mgr.Resolvers is left unset.
+var defaultResolvers = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+const (
+	defaultPropagationTimeout = 60 * time.Second
+	defaultPollingInterval    = 2 * time.Second
+)
+
 // Mgr is responsible to configure CoreDNS trough its redis pluging
 type Mgr struct {
 	redis    *redis.Pool
 	identity string
+
+	// VerifyPropagation, when set, makes AddSubdomain and AddDomainDelagate
+	// block until the record they just wrote is visible from Resolvers
+	// before returning success.
+	VerifyPropagation bool
+	// Resolvers is the list of recursive nameservers (host:port) used by
+	// WaitForPropagation. Defaults to 1.1.1.1 and 8.8.8.8.
+	Resolvers []string
+	// PropagationTimeout bounds how long WaitForPropagation polls Resolvers
+	// before giving up.
+	PropagationTimeout time.Duration
+	// PollingInterval is the delay between successive rounds of propagation
+	// checks against Resolvers.
+	PollingInterval time.Duration
+	// AXFRAllowedFrom, when set, is consulted by ServeAXFR with the
+	// requesting client's address (host:port, as reported by
+	// dns.ResponseWriter.RemoteAddr) before answering a transfer; a zone is
+	// only ever exported to clients remoteAddr accepts. ServeAXFR transfers
+	// every record of a zone, including subdomain topology, so operators
+	// exposing it beyond a trusted network must set this.
+	AXFRAllowedFrom func(remoteAddr string) bool
 }
 
 // New creates a DNS manager
 func New(pool *redis.Pool, identity string) *Mgr {
 	return &Mgr{
-		redis:    pool,
-		identity: identity,
+		redis:              pool,
+		identity:           identity,
+		Resolvers:          defaultResolvers,
+		PropagationTimeout: defaultPropagationTimeout,
+		PollingInterval:    defaultPollingInterval,
 	}
 }
 
@@ -234,7 +269,10 @@ func (c *Mgr) AddSubdomain(user string, domain string, IPs []net.IP) error {
 		return err
 	}
 
-	name, zone := splitDomain(domain)
+	zone, name, err := c.FindZone(domain)
+	if err != nil {
+		return err
+	}
 
 	con := c.redis.Get()
 	defer con.Close()
@@ -283,6 +321,8 @@ func (c *Mgr) AddSubdomain(user string, domain string, IPs []net.IP) error {
 		return err
 	}
 
+	previous := zr.Records.Clone()
+
 	for _, ip := range IPs {
 		r := recordFromIP(ip)
 		zr.Add(r)
@@ -292,16 +332,211 @@ func (c *Mgr) AddSubdomain(user string, domain string, IPs []net.IP) error {
 		return err
 	}
 
+	if c.VerifyPropagation {
+		expected := make([]Record, 0, len(IPs))
+		for _, ip := range IPs {
+			expected = append(expected, recordFromIP(ip))
+		}
+
+		if err = c.WaitForPropagation(domain, expected); err != nil {
+			// the record write already committed, so a retry must not find
+			// it still there: otherwise it would layer a second, never
+			// confirmed IP on top instead of cleanly redoing the write.
+			if rbErr := c.restoreZoneRecords(zone, name, previous); rbErr != nil {
+				log.Error().Err(rbErr).Msg("failed to roll back zone records after propagation failure")
+			}
+			return errors.Wrapf(err, "dns propagation check failed for subdomain %s", domain)
+		}
+	}
+
 	return nil
 }
 
+// restoreZoneRecords resets name in zone back to previous, deleting the
+// entry entirely if previous held no records.
+func (c *Mgr) restoreZoneRecords(zone, name string, previous records) error {
+	if previous.IsEmpty() {
+		return c.deleteZoneRecords(zone, name)
+	}
+	return c.setZoneRecords(zone, name, Zone{Records: previous})
+}
+
+// AddRecords configures fqdn with an arbitrary set of records on behalf of
+// user. Unlike AddSubdomain (A/AAAA only) and AddTXTRecord (TXT only) it
+// accepts any Record, so it is the entry point for record types such as
+// RecordCNAME, RecordMX, RecordSRV or RecordCAA.
+func (c *Mgr) AddRecords(user, fqdn string, records []Record) error {
+	if err := validateDomain(fqdn); err != nil {
+		return err
+	}
+
+	zone, name, err := c.FindZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return fmt.Errorf("failed to read the DNS zone %s: %w", zone, err)
+	}
+
+	if owner.Owner == "" {
+		return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	}
+
+	if owner.Owner != c.identity && owner.Owner != user {
+		return errors.Wrapf(ErrAuth, "cannot add records to zone %s", zone)
+	}
+
+	if owner.Owner == c.identity { // this is a managed domain
+		subOwner, err := c.getSubdomainOwner(fqdn)
+		if err != nil {
+			return err
+		}
+
+		if subOwner != "" && subOwner != user {
+			return errors.Wrapf(ErrAuth, "cannot add records to subdomain %s of zone %s", name, zone)
+		}
+	}
+
+	zr, err := c.getZoneRecords(zone, name)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		zr.Add(r)
+	}
+
+	return c.setZoneRecords(zone, name, zr)
+}
+
+// AddTXTRecord configures a TXT record on fqdn on behalf of user, parallel to
+// AddSubdomain but for arbitrary TXT values instead of A/AAAA records derived
+// from an IP. It is intended for short-lived records such as ACME DNS-01
+// challenges, so unlike AddSubdomain it does not reserve the name in
+// managed_domains: the name remains available for normal subdomain use.
+func (c *Mgr) AddTXTRecord(user, fqdn, value string, ttl int) error {
+	log.Info().Msgf("add TXT record %s %s", fqdn, value)
+
+	if err := validateDomain(fqdn); err != nil {
+		return err
+	}
+
+	zone, name, err := c.FindZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return fmt.Errorf("failed to read the DNS zone %s: %w", zone, err)
+	}
+
+	if owner.Owner == "" {
+		return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	}
+
+	if owner.Owner != c.identity && owner.Owner != user {
+		return errors.Wrapf(ErrAuth, "cannot add TXT record to zone %s", zone)
+	}
+
+	if owner.Owner == c.identity { // this is a managed domain
+		// an ACME DNS-01 fqdn is "_acme-challenge.<name being validated>", so
+		// the reservation to check is on the name being validated, not on
+		// "_acme-challenge.<name>" itself which is never reserved.
+		target := strings.TrimPrefix(fqdn, "_acme-challenge.")
+
+		subOwner, err := c.getSubdomainOwner(target)
+		if err != nil {
+			return err
+		}
+
+		if subOwner != "" && subOwner != user {
+			return errors.Wrapf(ErrAuth, "cannot add TXT record to subdomain %s of zone %s", name, zone)
+		}
+	}
+
+	zr, err := c.getZoneRecords(zone, name)
+	if err != nil {
+		return err
+	}
+
+	zr.Add(RecordTXT{Text: value, TTL: ttl})
+
+	return c.setZoneRecords(zone, name, zr)
+}
+
+// RemoveTXTRecord removes a TXT record added with AddTXTRecord.
+func (c *Mgr) RemoveTXTRecord(user, fqdn, value string) error {
+	if err := validateDomain(fqdn); err != nil {
+		return err
+	}
+
+	zone, name, err := c.FindZone(fqdn)
+	if err != nil {
+		if errors.Is(err, ErrZoneNotFound) {
+			// zone not managed anymore, nothing left to clean up
+			return nil
+		}
+		return err
+	}
+
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return fmt.Errorf("failed to read the DNS zone %s: %w", zone, err)
+	}
+
+	if owner.Owner == "" {
+		// zone not managed anymore, nothing left to clean up
+		return nil
+	}
+
+	if owner.Owner != c.identity && owner.Owner != user {
+		return errors.Wrapf(ErrAuth, "cannot remove TXT record from zone %s", zone)
+	}
+
+	zr, err := c.getZoneRecords(zone, name)
+	if err != nil {
+		return err
+	}
+
+	// match on Text alone: TTL is not part of the challenge value and the
+	// caller removing a TXT record has no reason to remember the TTL it
+	// was added with.
+	kept := zr.Records[RecordTypeTXT][:0]
+	for _, r := range zr.Records[RecordTypeTXT] {
+		if txt := r.(RecordTXT); txt.Text != value {
+			kept = append(kept, r)
+		}
+	}
+	zr.Records[RecordTypeTXT] = kept
+
+	if zr.Records.IsEmpty() {
+		return c.deleteZoneRecords(zone, name)
+	}
+
+	return c.setZoneRecords(zone, name, zr)
+}
+
 // RemoveSubdomain remove a domain added with AddSubdomain
 func (c *Mgr) RemoveSubdomain(user string, domain string, IPs []net.IP) error {
 	if err := validateDomain(domain); err != nil {
 		return err
 	}
 
-	name, zone := splitDomain(domain)
+	zone, name, err := c.FindZone(domain)
+	if err != nil {
+		if errors.Is(err, ErrZoneNotFound) {
+			// no ancestor zone at all, so all subdomain are already gone too.
+			// this can happen when a delegated domain expires before a subdomain
+
+			// we can safely then delete the subdomain owner
+			// as a way of clean up. (records already gone with the domain)
+			return c.deleteSubdomainOwner(domain)
+		}
+		return err
+	}
 
 	con := c.redis.Get()
 	defer con.Close()
@@ -363,6 +598,19 @@ func (c *Mgr) AddDomainDelagate(identity, user, domain string) error {
 		return err
 	}
 
+	if ancestor, _, ok, err := c.findLocalZone(domain); err != nil {
+		return err
+	} else if ok && ancestor != domain {
+		ancestorOwner, err := c.getZoneOwner(ancestor)
+		if err != nil {
+			return err
+		}
+
+		if ancestorOwner.Owner != "" && ancestorOwner.Owner != user {
+			return errors.Wrapf(ErrAuth, "cannot delegate %s, it is part of managed zone %s", domain, ancestor)
+		}
+	}
+
 	owner, err := c.getZoneOwner(domain)
 	if err != nil {
 		return err
@@ -372,16 +620,49 @@ func (c *Mgr) AddDomainDelagate(identity, user, domain string) error {
 		return fmt.Errorf("%w cannot delegate domain %s", ErrAuth, domain)
 	}
 
+	previousOwner := owner.Owner
+	previousTXT, err := c.getZoneRecords(domain, ownerTXTName)
+	if err != nil {
+		return err
+	}
+
 	owner.Owner = user
 	if err := c.setZoneOwner(domain, owner); err != nil {
 		return errors.Wrap(err, "failed to set zone owner")
 	}
 
-	return c.setZoneOwnerTXTRecord(domain, identity, owner.Owner)
+	r, err := c.setZoneOwnerTXTRecord(domain, identity, owner.Owner)
+	if err != nil {
+		return err
+	}
+
+	if c.VerifyPropagation {
+		fqdn := fmt.Sprintf("%s.%s", ownerTXTName, domain)
+		if err := c.WaitForPropagation(fqdn, []Record{r}); err != nil {
+			// setZoneOwner and the owner TXT record already committed, so
+			// undo both: otherwise the domain is left permanently delegated
+			// to user even though the caller was told the call failed, and
+			// the ErrAuth check above would then block anyone else from
+			// delegating it.
+			if rbErr := c.setZoneOwner(domain, ZoneOwner{Owner: previousOwner}); rbErr != nil {
+				log.Error().Err(rbErr).Msg("failed to roll back zone owner after propagation failure")
+			}
+			if rbErr := c.restoreZoneRecords(domain, ownerTXTName, previousTXT.Records); rbErr != nil {
+				log.Error().Err(rbErr).Msg("failed to roll back owner TXT record after propagation failure")
+			}
+			return errors.Wrapf(err, "dns propagation check failed for delegated domain %s", domain)
+		}
+	}
+
+	return nil
 }
 
-func (c *Mgr) setZoneOwnerTXTRecord(domain, identity, owner string) error {
-	const name = "__owner__"
+// ownerTXTName is the name the __owner__ TXT record written by
+// setZoneOwnerTXTRecord is stored under, relative to the delegated domain.
+const ownerTXTName = "__owner__"
+
+func (c *Mgr) setZoneOwnerTXTRecord(domain, identity, owner string) (RecordTXT, error) {
+	const name = ownerTXTName
 	var zone Zone
 	// we are not using the ZoneOwner struct because of
 	// 1- backward compatibility issue since it does not define json tags
@@ -396,12 +677,17 @@ func (c *Mgr) setZoneOwnerTXTRecord(domain, identity, owner string) error {
 
 	bytes, err := json.Marshal(data)
 	if err != nil {
-		return errors.Wrap(err, "failed to create owner TXT record")
+		return RecordTXT{}, errors.Wrap(err, "failed to create owner TXT record")
 	}
 
-	zone.Add(RecordTXT{Text: string(bytes), TTL: 600})
+	r := RecordTXT{Text: string(bytes), TTL: 600}
+	zone.Add(r)
 
-	return c.setZoneRecords(domain, name, zone)
+	if err := c.setZoneRecords(domain, name, zone); err != nil {
+		return RecordTXT{}, err
+	}
+
+	return r, nil
 }
 
 // RemoveDomainDelagate remove a delagated domain added with AddDomainDelagate
@@ -422,26 +708,251 @@ func (c *Mgr) RemoveDomainDelagate(user string, domain string) error {
 	con := c.redis.Get()
 	defer con.Close()
 
-	// TODO IMPORTANT: delete all sub-domain owners
-	// we need to go over all managed_domains
-	// do hkeys managed_domains, find all keys that has domain as suffix
-	// delete
+	// gather the owner entries of every subdomain provisioned under this
+	// zone so they can be cascaded away with it, otherwise they are leaked
+	// in managed_domains and block legitimate re-provisioning of the same
+	// names by other users once the zone is re-delegated.
+	keys, err := redis.Strings(con.Do("HKEYS", "managed_domains"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list managed domains")
+	}
+
+	if err := con.Send("MULTI"); err != nil {
+		return err
+	}
 
 	// remove all eventual subdomain configuration for this delegated domain
-	if _, err = con.Do("DEL", domain); err != nil {
+	if err := con.Send("DEL", domain); err != nil {
 		return err
 	}
 
-	_, err = con.Do("HDEL", "zone", domain)
+	if err := con.Send("HDEL", "zone", domain); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if isSubdomainOf(key, domain) {
+			if err := con.Send("HDEL", "managed_domains", key); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = con.Do("EXEC")
 	return err
 }
 
-func splitDomain(d string) (name, domain string) {
-	ss := strings.Split(d, ".")
-	if len(ss) < 3 {
-		return "", d
+// isSubdomainOf reports whether fqdn is domain itself or sits under it,
+// respecting label boundaries so "foo.example.com" is not matched by the
+// zone "ample.com".
+func isSubdomainOf(fqdn, domain string) bool {
+	return fqdn == domain || strings.HasSuffix(fqdn, "."+domain)
+}
+
+// WaitForPropagation polls Resolvers until every one of them answers fqdn
+// with the expected rrset, or returns an error once PropagationTimeout has
+// elapsed. It exists because CoreDNS+Redis writes are visible locally right
+// away, but upstream recursive resolvers used by ACME validators or health
+// checks may still serve a stale (or empty) answer for a short while.
+func (c *Mgr) WaitForPropagation(fqdn string, expected []Record) error {
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+
+	deadline := time.Now().Add(c.PropagationTimeout)
+
+	for {
+		propagated := true
+		for _, resolver := range c.Resolvers {
+			ok, err := recordsPropagated(resolver, fqdn, expected)
+			if err != nil {
+				log.Debug().Err(err).Str("resolver", resolver).Str("fqdn", fqdn).Msg("propagation check failed")
+			}
+
+			log.Debug().Str("resolver", resolver).Str("fqdn", fqdn).Bool("propagated", ok).Msg("propagation check")
+
+			if !ok {
+				propagated = false
+			}
+		}
+
+		if propagated {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s to propagate to all resolvers", fqdn)
+		}
+
+		time.Sleep(c.PollingInterval)
 	}
-	return ss[0], strings.Join(ss[1:], ".")
+}
+
+// recordsPropagated reports whether resolver already answers fqdn with every
+// record in expected.
+func recordsPropagated(resolver, fqdn string, expected []Record) (bool, error) {
+	client := new(dns.Client)
+
+	for _, r := range expected {
+		qtype, want, err := queryTypeAndValue(r)
+		if err != nil {
+			return false, err
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(fqdn, qtype)
+
+		resp, _, err := client.Exchange(m, resolver)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to query %s for %s", resolver, fqdn)
+		}
+
+		if !rrsetContains(resp.Answer, want) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// queryTypeAndValue returns the DNS question type and the textual value that
+// should show up in the answer for r.
+func queryTypeAndValue(r Record) (uint16, string, error) {
+	switch v := r.(type) {
+	case RecordA:
+		return dns.TypeA, v.IP4, nil
+	case RecordAAAA:
+		return dns.TypeAAAA, v.IP6, nil
+	case RecordTXT:
+		return dns.TypeTXT, v.Text, nil
+	default:
+		return 0, "", fmt.Errorf("propagation check not supported for record type %T", r)
+	}
+}
+
+func rrsetContains(rrset []dns.RR, want string) bool {
+	for _, rr := range rrset {
+		switch v := rr.(type) {
+		case *dns.A:
+			if v.A.String() == want {
+				return true
+			}
+		case *dns.AAAA:
+			if v.AAAA.String() == want {
+				return true
+			}
+		case *dns.TXT:
+			for _, txt := range v.Txt {
+				if txt == want {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// FindZone resolves fqdn to the managed zone it belongs to and the
+// subdomain under that zone, walking ancestor labels from most specific to
+// least specific. It checks each candidate against the zone hash in Redis
+// for ownership first, and falls back to an SOA lookup against Resolvers
+// when no ancestor matches a zone known locally. This replaces the previous
+// naive "always split on the first dot" behaviour, which mis-handled
+// two-label public suffixes (e.g. example.co.uk), managed zones with more
+// than three labels, and delegations whose apex sits deeper than one label.
+// A zone found by the SOA lookup is returned whether or not this gateway
+// manages it.
+func (c *Mgr) FindZone(fqdn string) (zone, subdomain string, err error) {
+	zone, subdomain, ok, err := c.findLocalZone(fqdn)
+	if err != nil {
+		return "", "", err
+	}
+	if ok {
+		return zone, subdomain, nil
+	}
+
+	zone, err = c.soaLookup(fqdn)
+	if err != nil {
+		return "", "", errors.Wrapf(ErrZoneNotFound, "%s: %s", fqdn, err)
+	}
+
+	return zone, trimZoneSuffix(fqdn, zone), nil
+}
+
+// findLocalZone walks the labels of fqdn from most specific to least
+// specific, looking for an ancestor that is a zone owned locally (i.e.
+// registered in the "zone" hash). It never touches the network.
+func (c *Mgr) findLocalZone(fqdn string) (zone, subdomain string, ok bool, err error) {
+	labels := dns.SplitDomainName(fqdn)
+	if labels == nil {
+		return "", "", false, fmt.Errorf("incorrect format for domain %s", fqdn)
+	}
+
+	for i := 0; i < len(labels); i++ {
+		candidate := strings.Join(labels[i:], ".")
+
+		owner, err := c.getZoneOwner(candidate)
+		if err != nil {
+			return "", "", false, err
+		}
+
+		if owner.Owner != "" {
+			return candidate, strings.Join(labels[:i], "."), true, nil
+		}
+	}
+
+	return "", "", false, nil
+}
+
+// soaLookup queries Resolvers for the SOA record covering fqdn, returning the
+// owner name of that SOA (the zone apex).
+func (c *Mgr) soaLookup(fqdn string) (string, error) {
+	if len(c.Resolvers) == 0 {
+		return "", fmt.Errorf("no resolvers configured")
+	}
+
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+
+	client := &dns.Client{Timeout: 3 * time.Second}
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	m.RecursionDesired = true
+
+	var lastErr error
+	for _, resolver := range c.Resolvers {
+		resp, _, err := client.Exchange(m, resolver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// fqdn is usually not a zone apex itself (FindZone is called with
+		// full subdomains like "www.example.com"), so a recursive resolver
+		// answers with the covering SOA in the authority section and an
+		// empty answer section; only an apex query gets the SOA as a direct
+		// answer. Check both.
+		for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return strings.ToLower(strings.TrimSuffix(soa.Hdr.Name, ".")), nil
+			}
+		}
+
+		lastErr = fmt.Errorf("no SOA record found for %s on %s", fqdn, resolver)
+	}
+
+	return "", lastErr
+}
+
+// trimZoneSuffix returns the part of fqdn that sits under zone, e.g.
+// trimZoneSuffix("a.b.example.com", "example.com") returns "a.b".
+func trimZoneSuffix(fqdn, zone string) string {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	sub := strings.TrimSuffix(fqdn, zone)
+	return strings.TrimSuffix(sub, ".")
 }
 
 func recordFromIP(ip net.IP) (r Record) {
@@ -6,49 +6,106 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/threefoldtech/zos/pkg/identity"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/threefoldtech/tfgateway/redis"
 )
 
-func Test_splitDomain(t *testing.T) {
+func TestFindZone(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool, "id")
+	// disable the SOA fallback so lookups that miss every local candidate
+	// fail fast instead of reaching out to the network in tests
+	mgr.Resolvers = nil
+
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "b.c.domain.com"))
+
 	tests := []struct {
-		domain string
-		name   string
-		zone   string
+		fqdn      string
+		zone      string
+		subdomain string
 	}{
 		{
-			domain: "domain.com",
-			name:   "",
-			zone:   "domain.com",
-		},
-		{
-			domain: "a.domain.com",
-			name:   "a",
-			zone:   "domain.com",
+			fqdn:      "b.c.domain.com",
+			zone:      "b.c.domain.com",
+			subdomain: "",
 		},
 		{
-			domain: "a.b.c.domain.com",
-			name:   "a",
-			zone:   "b.c.domain.com",
-		},
-		{
-			domain: "bleh.grid.deboeck.xyz",
-			name:   "bleh",
-			zone:   "grid.deboeck.xyz",
+			fqdn:      "a.b.c.domain.com",
+			zone:      "b.c.domain.com",
+			subdomain: "a",
 		},
 	}
 	for _, tt := range tests {
-		t.Run(tt.domain, func(t *testing.T) {
-			name, zone := splitDomain(tt.domain)
-			assert.Equal(t, tt.name, name)
+		t.Run(tt.fqdn, func(t *testing.T) {
+			zone, subdomain, err := mgr.FindZone(tt.fqdn)
+			require.NoError(t, err)
 			assert.Equal(t, tt.zone, zone)
+			assert.Equal(t, tt.subdomain, subdomain)
 		})
 	}
+
+	_, _, err = mgr.FindZone("sub.notdelegated.com")
+	assert.True(t, errors.Is(err, ErrZoneNotFound))
+}
+
+// TestFindZoneSOAFallbackUsesAuthoritySection covers the common case the SOA
+// fallback exists for: fqdn is a subdomain, not a zone apex, so a recursive
+// resolver answers with the covering SOA in the authority section and an
+// empty answer section.
+func TestFindZoneSOAFallbackUsesAuthoritySection(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool, "id")
+
+	const apex = "external.com"
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		// No direct answer for the queried (non-apex) name: the SOA for the
+		// covering zone is only carried in the authority section, as real
+		// recursive resolvers do.
+		m.Ns = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{Name: dns.Fqdn(apex), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  "ns1." + dns.Fqdn(apex), Mbox: "hostmaster." + dns.Fqdn(apex),
+			},
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	mgr.Resolvers = []string{pc.LocalAddr().String()}
+
+	zone, subdomain, err := mgr.FindZone("deep.sub.external.com")
+	require.NoError(t, err)
+	assert.Equal(t, apex, zone)
+	assert.Equal(t, "deep.sub", subdomain)
 }
 
 func Test_validateDomain(t *testing.T) {
@@ -226,6 +283,7 @@ func TestDomainDelegate(t *testing.T) {
 	require.NoError(t, err)
 
 	mgr := New(pool, "")
+	mgr.Resolvers = nil
 
 	id := "id"
 	user := "user"
@@ -254,6 +312,7 @@ func TestSubdomain(t *testing.T) {
 	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
 	require.NoError(t, err)
 	mgr := New(pool, "")
+	mgr.Resolvers = nil
 
 	id := "id"
 	user := "user"
@@ -282,7 +341,7 @@ func TestSubdomain(t *testing.T) {
 
 	err = mgr.AddSubdomain(user, "sub.thisisnotdelegated.com", ips)
 	assert.Error(t, err)
-	assert.Equal(t, "thisisnotdelegated.com is not managed by the gateway. delegate the domain first", err.Error())
+	assert.True(t, errors.Is(err, ErrZoneNotFound))
 }
 
 func TestSubdomainChangeOwner(t *testing.T) {
@@ -296,6 +355,7 @@ func TestSubdomainChangeOwner(t *testing.T) {
 
 	gwid := "gwid"
 	mgr := New(pool, gwid)
+	mgr.Resolvers = nil
 
 	domain := "foo.mydomain.com"
 	subdomain := fmt.Sprintf("test.%s", domain)
@@ -330,6 +390,7 @@ func TestManagedDomain(t *testing.T) {
 	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
 	require.NoError(t, err)
 	mgr := New(pool, kp.Identity())
+	mgr.Resolvers = nil
 
 	zone := "managed-domain.com"
 	ips := []net.IP{
@@ -361,3 +422,270 @@ func TestManagedDomain(t *testing.T) {
 	err = mgr.AddSubdomain("user1", fmt.Sprintf("user2.%s", zone), ips)
 	assert.NoError(t, err, "any user can reuse a freed subdomain")
 }
+
+func TestRemoveDomainDelagateCascade(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool, "id")
+	mgr.Resolvers = nil
+
+	id := "id"
+	user := "user"
+	zone := "cascade.com"
+	sub := fmt.Sprintf("a.%s", zone)
+	unrelated := "a.notcascade.com"
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	require.NoError(t, mgr.AddDomainDelagate(id, user, zone))
+	require.NoError(t, mgr.AddSubdomain(user, sub, ips))
+
+	require.NoError(t, mgr.AddDomainDelagate(id, user, "notcascade.com"))
+	require.NoError(t, mgr.AddSubdomain(user, unrelated, ips))
+
+	require.NoError(t, mgr.RemoveDomainDelagate(user, zone))
+
+	owner, err := mgr.getSubdomainOwner(sub)
+	require.NoError(t, err)
+	assert.Equal(t, "", owner, "subdomain owner should be cascaded away with its zone")
+
+	owner, err = mgr.getSubdomainOwner(unrelated)
+	require.NoError(t, err)
+	assert.Equal(t, user, owner, "subdomains of unrelated zones must not be touched")
+
+	// the freed subdomain name can be reclaimed by another user once the zone
+	// is re-delegated as a zone managed by the gateway
+	require.NoError(t, mgr.AddDomainDelagate(id, id, zone))
+	assert.NoError(t, mgr.AddSubdomain("user2", sub, ips))
+}
+
+func TestLoadRecordsAllTypes(t *testing.T) {
+	z := Zone{}
+	z.Add(RecordCNAME{Host: "target.example.com", TTL: 3600})
+	z.Add(RecordMX{Host: "mail.example.com", Preference: 10, TTL: 3600})
+	z.Add(RecordSRV{Target: "sip.example.com", Port: 5060, Priority: 10, Weight: 60, TTL: 3600})
+	z.Add(RecordCAA{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 3600})
+
+	b, err := json.Marshal(z.Records)
+	require.NoError(t, err)
+
+	z2 := Zone{Records: records{}}
+	err = json.Unmarshal(b, &z2.Records)
+	require.NoError(t, err)
+	assert.Equal(t, z.Records, z2.Records)
+}
+
+func TestAddRecords(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool, "id")
+	mgr.Resolvers = nil
+
+	id := "id"
+	user := "user"
+	zone := "records.com"
+	fqdn := fmt.Sprintf("mail.%s", zone)
+
+	require.NoError(t, mgr.AddDomainDelagate(id, user, zone))
+
+	err = mgr.AddRecords(user, fqdn, []Record{
+		RecordMX{Host: "mailhost.example.com", Preference: 10, TTL: 3600},
+		RecordCAA{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 3600},
+	})
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords(zone, "mail")
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeMX], 1)
+	assert.Len(t, zr.Records[RecordTypeCAA], 1)
+
+	err = mgr.AddRecords("user2", fqdn, []Record{RecordCNAME{Host: "other.example.com", TTL: 3600}})
+	assert.Error(t, err, "only the zone owner can add records")
+	assert.True(t, errors.Is(err, ErrAuth))
+}
+
+func TestAddRecordsManagedZoneSubdomainOwnership(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	id := "id"
+	mgr := New(pool, id)
+	mgr.Resolvers = nil
+
+	zone := "shared.com"
+	fqdn := fmt.Sprintf("user1.%s", zone)
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	require.NoError(t, mgr.AddDomainDelagate(id, id, zone))
+	require.NoError(t, mgr.AddSubdomain("user1", fqdn, ips))
+
+	err = mgr.AddRecords("user2", fqdn, []Record{RecordCNAME{Host: "other.example.com", TTL: 3600}})
+	assert.Error(t, err, "a user cannot add records onto a subdomain claimed by someone else")
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.AddRecords("user1", fqdn, []Record{RecordCNAME{Host: "other.example.com", TTL: 3600}})
+	assert.NoError(t, err, "the subdomain owner can add records onto their own subdomain")
+}
+
+func TestAddTXTRecordManagedZoneSubdomainOwnership(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	id := "id"
+	mgr := New(pool, id)
+	mgr.Resolvers = nil
+
+	zone := "shared-txt.com"
+	fqdn := fmt.Sprintf("user1.%s", zone)
+	challengeFqdn := fmt.Sprintf("_acme-challenge.%s", fqdn)
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	require.NoError(t, mgr.AddDomainDelagate(id, id, zone))
+	require.NoError(t, mgr.AddSubdomain("user1", fqdn, ips))
+
+	err = mgr.AddTXTRecord("user2", challengeFqdn, "forged-value", 120)
+	assert.Error(t, err, "a user cannot write an ACME challenge onto a subdomain claimed by someone else")
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.AddTXTRecord("user1", challengeFqdn, "real-value", 120)
+	assert.NoError(t, err, "the subdomain owner can complete their own ACME challenge")
+}
+
+// unreachablePropagationResolver never answers, so recordsPropagated always
+// fails fast (connection refused) without touching the real network.
+const unreachablePropagationResolver = "127.0.0.1:1"
+
+func TestAddSubdomainRollsBackOnPropagationFailure(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	id := "id"
+	user := "user"
+	zone := "propfail.com"
+	name := "test"
+	domain := fmt.Sprintf("%s.%s", name, zone)
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	mgr := New(pool, id)
+	mgr.Resolvers = nil
+	require.NoError(t, mgr.AddDomainDelagate(id, user, zone))
+
+	mgr.VerifyPropagation = true
+	mgr.Resolvers = []string{unreachablePropagationResolver}
+	mgr.PropagationTimeout = 50 * time.Millisecond
+	mgr.PollingInterval = 10 * time.Millisecond
+
+	err = mgr.AddSubdomain(user, domain, ips)
+	require.Error(t, err)
+
+	owner, err := mgr.getSubdomainOwner(domain)
+	require.NoError(t, err)
+	assert.Equal(t, "", owner, "subdomain reservation should be rolled back on propagation failure")
+
+	zr, err := mgr.getZoneRecords(zone, name)
+	require.NoError(t, err)
+	assert.True(t, zr.Records.IsEmpty(), "record write should be rolled back on propagation failure")
+
+	// a retry, once propagation is no longer required, must not find any
+	// leftover state blocking it or duplicating its record.
+	mgr.VerifyPropagation = false
+	require.NoError(t, mgr.AddSubdomain(user, domain, ips))
+	zr, err = mgr.getZoneRecords(zone, name)
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeA], 1)
+}
+
+func TestAddDomainDelagateRollsBackOnPropagationFailure(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	id := "id"
+	user := "user"
+	domain := "propfail-delegate.com"
+
+	mgr := New(pool, id)
+	mgr.VerifyPropagation = true
+	mgr.Resolvers = []string{unreachablePropagationResolver}
+	mgr.PropagationTimeout = 50 * time.Millisecond
+	mgr.PollingInterval = 10 * time.Millisecond
+
+	err = mgr.AddDomainDelagate(id, user, domain)
+	require.Error(t, err)
+
+	owner, err := mgr.getZoneOwner(domain)
+	require.NoError(t, err)
+	assert.Equal(t, "", owner.Owner, "zone owner should be rolled back on propagation failure")
+
+	zr, err := mgr.getZoneRecords(domain, ownerTXTName)
+	require.NoError(t, err)
+	assert.True(t, zr.Records.IsEmpty(), "owner TXT record should be rolled back on propagation failure")
+
+	// once rolled back cleanly, a retry with propagation disabled must succeed
+	mgr.VerifyPropagation = false
+	require.NoError(t, mgr.AddDomainDelagate(id, user, domain))
+}
+
+func TestQueryTypeAndValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  Record
+		qtype   uint16
+		value   string
+		wantErr bool
+	}{
+		{name: "A", record: RecordA{IP4: "10.0.0.1"}, qtype: dns.TypeA, value: "10.0.0.1"},
+		{name: "AAAA", record: RecordAAAA{IP6: "::1"}, qtype: dns.TypeAAAA, value: "::1"},
+		{name: "TXT", record: RecordTXT{Text: "hello world"}, qtype: dns.TypeTXT, value: "hello world"},
+		{name: "unsupported", record: RecordCNAME{Host: "target.example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qtype, value, err := queryTypeAndValue(tt.record)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.qtype, qtype)
+			assert.Equal(t, tt.value, value)
+		})
+	}
+}
+
+func TestRrsetContains(t *testing.T) {
+	rrset := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA}, A: net.ParseIP("10.0.0.1")},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeTXT}, Txt: []string{"hello", "world"}},
+	}
+
+	assert.True(t, rrsetContains(rrset, "10.0.0.1"))
+	assert.True(t, rrsetContains(rrset, "world"))
+	assert.False(t, rrsetContains(rrset, "10.0.0.2"))
+	assert.False(t, rrsetContains(rrset, "nope"))
+}
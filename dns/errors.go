@@ -0,0 +1,8 @@
+package dns
+
+import "errors"
+
+// ErrZoneNotFound is returned by FindZone when no ancestor label of the
+// queried fqdn matches a zone managed by this gateway, and the SOA lookup
+// against Resolvers fails or finds no SOA record either.
+var ErrZoneNotFound = errors.New("no managed zone found for domain")
@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// RecordType identifies the kind of a DNS record, keyed by the field name
+// the CoreDNS redis plugin stores it under.
+type RecordType string
+
+// Record types supported by the gateway. Adding a new one only requires a
+// struct implementing Record and an entry in recordTypes below; Zone.Add,
+// Zone.Remove and the records JSON (de)serialization are type-generic and
+// need no further changes.
+const (
+	RecordTypeA     RecordType = "a"
+	RecordTypeAAAA  RecordType = "aaaa"
+	RecordTypeTXT   RecordType = "txt"
+	RecordTypeCNAME RecordType = "cname"
+	RecordTypeMX    RecordType = "mx"
+	RecordTypeSRV   RecordType = "srv"
+	RecordTypeCAA   RecordType = "caa"
+)
+
+// Record is a single DNS resource record stored under a name in a Zone.
+type Record interface {
+	// Type reports the RecordType r is stored as.
+	Type() RecordType
+}
+
+// recordTypes is the registry mapping a RecordType to the concrete Go type
+// implementing it. records.UnmarshalJSON uses it to decode the polymorphic
+// record set the CoreDNS redis plugin stores per name.
+var recordTypes = map[RecordType]reflect.Type{
+	RecordTypeA:     reflect.TypeOf(RecordA{}),
+	RecordTypeAAAA:  reflect.TypeOf(RecordAAAA{}),
+	RecordTypeTXT:   reflect.TypeOf(RecordTXT{}),
+	RecordTypeCNAME: reflect.TypeOf(RecordCNAME{}),
+	RecordTypeMX:    reflect.TypeOf(RecordMX{}),
+	RecordTypeSRV:   reflect.TypeOf(RecordSRV{}),
+	RecordTypeCAA:   reflect.TypeOf(RecordCAA{}),
+}
+
+// RecordA is an IPv4 address record.
+type RecordA struct {
+	IP4 string `json:"ip4"`
+	TTL int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordA) Type() RecordType { return RecordTypeA }
+
+// RecordAAAA is an IPv6 address record.
+type RecordAAAA struct {
+	IP6 string `json:"ip6"`
+	TTL int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordAAAA) Type() RecordType { return RecordTypeAAAA }
+
+// RecordTXT is a free-form text record.
+type RecordTXT struct {
+	Text string `json:"text"`
+	TTL  int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordTXT) Type() RecordType { return RecordTypeTXT }
+
+// RecordCNAME aliases a name to Host.
+type RecordCNAME struct {
+	Host string `json:"host"`
+	TTL  int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordCNAME) Type() RecordType { return RecordTypeCNAME }
+
+// RecordMX is a mail exchange record. The field is named Preference, not
+// Priority, to match RFC 1035 and miekg/dns.MX.Preference.
+type RecordMX struct {
+	Host       string `json:"host"`
+	Preference uint16 `json:"preference"`
+	TTL        int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordMX) Type() RecordType { return RecordTypeMX }
+
+// RecordSRV is a service locator record.
+type RecordSRV struct {
+	Target   string `json:"target"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	TTL      int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordSRV) Type() RecordType { return RecordTypeSRV }
+
+// RecordCAA restricts which certificate authorities may issue certificates
+// for the zone, or which policies they must follow.
+type RecordCAA struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl"`
+}
+
+// Type implements Record.
+func (RecordCAA) Type() RecordType { return RecordTypeCAA }
+
+// ZoneOwner tracks who owns a zone managed or delegated to the gateway.
+type ZoneOwner struct {
+	Owner string `json:"owner"`
+}
+
+// records is the set of DNS records configured for a single name, indexed
+// by RecordType, mirroring the JSON shape the CoreDNS redis plugin expects.
+type records map[RecordType][]Record
+
+// rawRecords is the plain map underlying records, used to marshal without
+// recursing back into records.MarshalJSON.
+type rawRecords map[RecordType][]Record
+
+// MarshalJSON renders r as CoreDNS-redis expects: one array of records per
+// record type, keyed by its field name.
+func (r records) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rawRecords(r))
+}
+
+// UnmarshalJSON decodes a CoreDNS-redis record set, looking up the concrete
+// Go type for each RecordType in the recordTypes registry.
+func (r *records) UnmarshalJSON(data []byte) error {
+	var raw map[RecordType][]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	out := make(records, len(raw))
+	for t, entries := range raw {
+		typ, ok := recordTypes[t]
+		if !ok {
+			return fmt.Errorf("unknown record type %q", t)
+		}
+
+		list := make([]Record, 0, len(entries))
+		for _, entry := range entries {
+			v := reflect.New(typ)
+			if err := json.Unmarshal(entry, v.Interface()); err != nil {
+				return err
+			}
+			list = append(list, v.Elem().Interface().(Record))
+		}
+		out[t] = list
+	}
+
+	*r = out
+	return nil
+}
+
+// IsEmpty reports whether there are no records left of any type.
+func (r records) IsEmpty() bool {
+	for _, rs := range r {
+		if len(rs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of r, so the caller can mutate the original
+// (e.g. via Zone.Add) while keeping a snapshot to roll back to.
+func (r records) Clone() records {
+	out := make(records, len(r))
+	for t, rs := range r {
+		cp := make([]Record, len(rs))
+		copy(cp, rs)
+		out[t] = cp
+	}
+	return out
+}
+
+// Zone is the set of records configured for a single name in a managed or
+// delegated domain.
+type Zone struct {
+	Records records `json:"records"`
+}
+
+// Add appends r to the zone under its record type.
+func (z *Zone) Add(r Record) {
+	if z.Records == nil {
+		z.Records = records{}
+	}
+	z.Records[r.Type()] = append(z.Records[r.Type()], r)
+}
+
+// Remove deletes the first record equal to r from the zone, if present.
+func (z *Zone) Remove(r Record) {
+	list := z.Records[r.Type()]
+	for i, existing := range list {
+		if reflect.DeepEqual(existing, r) {
+			z.Records[r.Type()] = append(list[:i], list[i+1:]...)
+			return
+		}
+	}
+}
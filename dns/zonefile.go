@@ -0,0 +1,298 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// zoneRecordTypeOrder fixes the order record types are rendered in when
+// exporting a zone, so ExportZone output is stable across calls.
+var zoneRecordTypeOrder = []RecordType{
+	RecordTypeA,
+	RecordTypeAAAA,
+	RecordTypeCNAME,
+	RecordTypeMX,
+	RecordTypeSRV,
+	RecordTypeTXT,
+	RecordTypeCAA,
+}
+
+// ExportZone renders every record of zone from Redis into standard RFC 1035
+// zone-file format, giving operators a supported way to snapshot or migrate
+// a zone without dumping raw Redis. Records under the names reserved by
+// isReservedZoneName (__owner__, _acme-challenge) are not exported.
+func (c *Mgr) ExportZone(zone string) (io.Reader, error) {
+	zone = strings.TrimSuffix(zone, ".")
+
+	rrs, err := c.zoneRRs(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "$ORIGIN %s.\n", zone)
+	fmt.Fprintln(&buf, zoneSOA(zone).String())
+	for _, rr := range rrs {
+		fmt.Fprintln(&buf, rr.String())
+	}
+
+	return &buf, nil
+}
+
+// zoneSOA synthesizes a minimal SOA record for zone. The gateway does not
+// model SOA fields itself, so this picks sane static values: the common
+// ns1.<zone>/hostmaster.<zone> convention for Ns/Mbox, and conservative
+// timers. It exists so ExportZone and ServeAXFR produce a well-formed
+// zone transfer per RFC 1035/1996, which every resolver and `dig` expects
+// to start (and, for AXFR, end) with the zone's SOA.
+func zoneSOA(zone string) *dns.SOA {
+	zone = dns.Fqdn(zone)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns1." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minttl:  3600,
+	}
+}
+
+// zoneRRs reads every name of zone and returns its records as miekg/dns RRs,
+// in a stable order.
+func (c *Mgr) zoneRRs(zone string) ([]dns.RR, error) {
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return nil, err
+	}
+	if owner.Owner == "" {
+		return nil, errors.Wrapf(ErrZoneNotFound, "%s", zone)
+	}
+
+	con := c.redis.Get()
+	defer con.Close()
+
+	names, err := redis.Strings(con.Do("HKEYS", zone+"."))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list records of zone %s", zone)
+	}
+	sort.Strings(names)
+
+	var rrs []dns.RR
+	for _, name := range names {
+		if isReservedZoneName(name) {
+			continue
+		}
+
+		zr, err := c.getZoneRecords(zone, name)
+		if err != nil {
+			return nil, err
+		}
+
+		fqdn := zone + "."
+		if name != "" {
+			fqdn = name + "." + fqdn
+		}
+
+		for _, t := range zoneRecordTypeOrder {
+			for _, r := range zr.Records[t] {
+				rr, err := recordToRR(fqdn, r)
+				if err != nil {
+					return nil, err
+				}
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+
+	return rrs, nil
+}
+
+// acmeChallengeName is the name ACME DNS-01 TXT records are written under,
+// see AddTXTRecord.
+const acmeChallengeName = "_acme-challenge"
+
+// isReservedZoneName reports whether name is internal gateway bookkeeping
+// (the __owner__ TXT record, or a live ACME DNS-01 challenge) rather than a
+// record an operator asked for, so ExportZone/ServeAXFR don't leak it and
+// ImportZone can't be used to clobber it.
+func isReservedZoneName(name string) bool {
+	return name == ownerTXTName || name == acmeChallengeName || strings.HasPrefix(name, acmeChallengeName+".")
+}
+
+// ImportZone parses a zone file from r and writes each record it contains
+// back into zone on behalf of user, the symmetric counterpart of
+// ExportZone used to restore a backup or migrate a zone from another
+// gateway. SOA and NS records are ignored, since the gateway does not model
+// them itself, and so are records under the names reserved by
+// isReservedZoneName.
+func (c *Mgr) ImportZone(user, zone string, r io.Reader) error {
+	zone = strings.TrimSuffix(zone, ".")
+	if err := validateDomain(zone); err != nil {
+		return err
+	}
+
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return err
+	}
+	if owner.Owner == "" {
+		return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	}
+	if owner.Owner != user {
+		return errors.Wrapf(ErrAuth, "cannot import records into zone %s", zone)
+	}
+
+	zones := map[string]Zone{}
+
+	parser := dns.NewZoneParser(r, dns.Fqdn(zone), "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		record, name, skip, err := recordFromRR(rr, zone)
+		if err != nil {
+			return errors.Wrap(err, "failed to import zone file")
+		}
+		if skip || isReservedZoneName(name) {
+			continue
+		}
+
+		zr := zones[name]
+		zr.Add(record)
+		zones[name] = zr
+	}
+	if err := parser.Err(); err != nil {
+		return errors.Wrap(err, "failed to parse zone file")
+	}
+
+	for name, zr := range zones {
+		if err := c.setZoneRecords(zone, name, zr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ServeAXFR is a miekg/dns Handler answering AXFR requests for zones managed
+// by this gateway, so operators can register it with their own DNS server
+// (e.g. dns.HandleFunc(zone, mgr.ServeAXFR)) and run `dig AXFR @gateway
+// zone` for disaster-recovery snapshots.
+//
+// A full zone transfer hands out every record of the zone, including its
+// subdomain topology, to whoever asks: it carries no source or key
+// restriction of its own. Callers exposing this beyond a trusted network
+// MUST set Mgr.AXFRAllowedFrom to gate it.
+func (c *Mgr) ServeAXFR(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeAXFR {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeRefused)
+		_ = w.WriteMsg(reply)
+		return
+	}
+
+	if c.AXFRAllowedFrom != nil && !c.AXFRAllowedFrom(w.RemoteAddr().String()) {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeRefused)
+		_ = w.WriteMsg(reply)
+		return
+	}
+
+	zone := strings.TrimSuffix(req.Question[0].Name, ".")
+
+	rrs, err := c.zoneRRs(zone)
+	if err != nil {
+		log.Error().Err(err).Str("zone", zone).Msg("failed to export zone for AXFR")
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(reply)
+		return
+	}
+
+	// RFC 5936 requires an AXFR transfer to start and end with the zone's
+	// SOA, or resolvers and dig reject it as malformed.
+	soa := zoneSOA(zone)
+	envelope := append([]dns.RR{soa}, rrs...)
+	envelope = append(envelope, soa)
+
+	tr := new(dns.Transfer)
+	ch := make(chan *dns.Envelope, 1)
+	go func() {
+		ch <- &dns.Envelope{RR: envelope}
+		close(ch)
+	}()
+
+	if err := tr.Out(w, req, ch); err != nil {
+		log.Error().Err(err).Str("zone", zone).Msg("failed to send AXFR")
+	}
+
+	w.Hijack()
+}
+
+// recordToRR converts r, stored at fqdn, into the equivalent miekg/dns RR.
+func recordToRR(fqdn string, r Record) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: dns.Fqdn(fqdn), Class: dns.ClassINET}
+
+	switch v := r.(type) {
+	case RecordA:
+		hdr.Rrtype, hdr.Ttl = dns.TypeA, uint32(v.TTL)
+		return &dns.A{Hdr: hdr, A: net.ParseIP(v.IP4)}, nil
+	case RecordAAAA:
+		hdr.Rrtype, hdr.Ttl = dns.TypeAAAA, uint32(v.TTL)
+		return &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(v.IP6)}, nil
+	case RecordTXT:
+		hdr.Rrtype, hdr.Ttl = dns.TypeTXT, uint32(v.TTL)
+		return &dns.TXT{Hdr: hdr, Txt: []string{v.Text}}, nil
+	case RecordCNAME:
+		hdr.Rrtype, hdr.Ttl = dns.TypeCNAME, uint32(v.TTL)
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(v.Host)}, nil
+	case RecordMX:
+		hdr.Rrtype, hdr.Ttl = dns.TypeMX, uint32(v.TTL)
+		return &dns.MX{Hdr: hdr, Preference: v.Preference, Mx: dns.Fqdn(v.Host)}, nil
+	case RecordSRV:
+		hdr.Rrtype, hdr.Ttl = dns.TypeSRV, uint32(v.TTL)
+		return &dns.SRV{Hdr: hdr, Priority: v.Priority, Weight: v.Weight, Port: v.Port, Target: dns.Fqdn(v.Target)}, nil
+	case RecordCAA:
+		hdr.Rrtype, hdr.Ttl = dns.TypeCAA, uint32(v.TTL)
+		return &dns.CAA{Hdr: hdr, Flag: v.Flag, Tag: v.Tag, Value: v.Value}, nil
+	default:
+		return nil, fmt.Errorf("export not supported for record type %T", r)
+	}
+}
+
+// recordFromRR converts a parsed zone-file RR back into a Record and the
+// name it should be stored under, relative to zone. skip is true for record
+// types the gateway does not model (SOA, NS) and should be ignored.
+func recordFromRR(rr dns.RR, zone string) (r Record, name string, skip bool, err error) {
+	name = trimZoneSuffix(rr.Header().Name, zone)
+
+	switch v := rr.(type) {
+	case *dns.A:
+		return RecordA{IP4: v.A.String(), TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.AAAA:
+		return RecordAAAA{IP6: v.AAAA.String(), TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.TXT:
+		return RecordTXT{Text: strings.Join(v.Txt, ""), TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.CNAME:
+		return RecordCNAME{Host: strings.TrimSuffix(v.Target, "."), TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.MX:
+		return RecordMX{Host: strings.TrimSuffix(v.Mx, "."), Preference: v.Preference, TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.SRV:
+		return RecordSRV{Target: strings.TrimSuffix(v.Target, "."), Port: v.Port, Priority: v.Priority, Weight: v.Weight, TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.CAA:
+		return RecordCAA{Flag: v.Flag, Tag: v.Tag, Value: v.Value, TTL: int(v.Hdr.Ttl)}, name, false, nil
+	case *dns.SOA, *dns.NS:
+		return nil, "", true, nil
+	default:
+		return nil, "", false, fmt.Errorf("record type %T is not supported", rr)
+	}
+}
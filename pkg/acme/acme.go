@@ -0,0 +1,62 @@
+package acme
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/pkg/errors"
+
+	"github.com/threefoldtech/tfgateway/dns"
+)
+
+// defaultTTL is the TTL, in seconds, used for the TXT record written for a
+// DNS-01 challenge. It is kept short since the record is only needed for the
+// duration of the certificate issuance.
+const defaultTTL = 120
+
+// DNSProvider implements the lego challenge.Provider interface (DNS-01) by
+// writing and removing the challenge TXT record through the gateway's DNS
+// manager, so a managed or delegated zone can be used as the ACME DNS
+// provider without an external DNS API.
+type DNSProvider struct {
+	mgr  *dns.Mgr
+	user string
+}
+
+// NewDNSProvider creates a DNS-01 challenge provider backed by mgr, writing
+// challenge records on behalf of user.
+func NewDNSProvider(mgr *dns.Mgr, user string) *DNSProvider {
+	return &DNSProvider{
+		mgr:  mgr,
+		user: user,
+	}
+}
+
+// Present creates the TXT record for the DNS-01 challenge of domain.
+func (d *DNSProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	if err := d.mgr.AddTXTRecord(d.user, strings.TrimSuffix(fqdn, "."), value, defaultTTL); err != nil {
+		return errors.Wrapf(err, "failed to present dns-01 challenge for %s", domain)
+	}
+
+	return nil
+}
+
+// CleanUp removes the TXT record created by Present.
+func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	if err := d.mgr.RemoveTXTRecord(d.user, strings.TrimSuffix(fqdn, "."), value); err != nil {
+		return errors.Wrapf(err, "failed to clean up dns-01 challenge for %s", domain)
+	}
+
+	return nil
+}
+
+// Timeout returns the timeout and interval lego should use while polling for
+// the challenge record to become visible.
+func (d *DNSProvider) Timeout() (timeout, interval time.Duration) {
+	return 2 * time.Minute, 5 * time.Second
+}
@@ -0,0 +1,45 @@
+package acme
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/stretchr/testify/require"
+
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/redis"
+)
+
+func TestPresentCleanUp(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	id := "id"
+	user := "user"
+	domain := "example.com"
+
+	mgr := dns.New(pool, id)
+	require.NoError(t, mgr.AddDomainDelagate(id, user, domain))
+
+	provider := NewDNSProvider(mgr, user)
+
+	_, value := dns01.GetRecord(domain, "key-auth")
+
+	err = provider.Present(domain, "token", "key-auth")
+	require.NoError(t, err)
+	require.True(t, s.Exists(domain+"."))
+
+	// ExportZone leaves out live ACME challenges, so read the stored record set
+	require.Contains(t, s.HGet(domain+".", "_acme-challenge"), value, "TXT challenge record should be present after Present")
+
+	err = provider.CleanUp(domain, "token", "key-auth")
+	require.NoError(t, err)
+
+	require.NotContains(t, s.HGet(domain+".", "_acme-challenge"), value, "TXT challenge record should be removed after CleanUp")
+}